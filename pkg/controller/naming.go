@@ -0,0 +1,46 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+)
+
+// GetDestinationRuleName returns the name to give the Istio DestinationRule
+// generated for a Route.  Like GetVirtualServiceName, it reuses the
+// Route's own name; the two objects never collide because they're
+// distinct Kinds.
+func GetDestinationRuleName(route *v1alpha1.Route) string {
+	return route.Name
+}
+
+// GetHTTPRouteName returns the name to give the Gateway API HTTPRoute
+// generated for a Route, for clusters that generate Gateway API resources
+// instead of Istio VirtualServices/DestinationRules.
+func GetHTTPRouteName(route *v1alpha1.Route) string {
+	return route.Name
+}
+
+// GetHTTPRouteNameForTag returns the name to give the Gateway API HTTPRoute
+// generated for a single tag target group. Gateway API scopes Hostnames at
+// the HTTPRoute level, so each tag gets its own HTTPRoute object alongside
+// the root one GetHTTPRouteName names, and the two must never collide.
+func GetHTTPRouteNameForTag(route *v1alpha1.Route, tag string) string {
+	return fmt.Sprintf("%s-%s", route.Name, tag)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatewayapi
+
+import corev1 "k8s.io/api/core/v1"
+
+// IngressClassKey is the config-network key that selects which ingress
+// implementation the Route reconciler generates resources for.
+const IngressClassKey = "ingress.class"
+
+// GatewayAPIIngressClass is the IngressClassKey value that opts a cluster
+// into this package's generator instead of the istio package's
+// VirtualService/DestinationRule one.
+const GatewayAPIIngressClass = "gateway-api"
+
+// IsEnabled reports whether config-network selects the Gateway API
+// generator for the given config-network ConfigMap. A nil ConfigMap, or
+// one missing the key entirely, means the cluster is on the Istio
+// VirtualService path, matching today's default.
+func IsEnabled(configMap *corev1.ConfigMap) bool {
+	if configMap == nil {
+		return false
+	}
+	return configMap.Data[IngressClassKey] == GatewayAPIIngressClass
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gatewayapi generates Gateway API HTTPRoutes as an alternative to
+// the Istio VirtualService/DestinationRule generators in
+// github.com/knative/serving/pkg/controller/route/istio.  Which generator
+// runs is a reconciler-level choice, gated on the "ingress.class: gateway-api"
+// config-network setting; the two packages don't depend on each other.
+package gatewayapi
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/knative/serving/pkg"
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/controller"
+	"github.com/knative/serving/pkg/controller/revision"
+	"github.com/knative/serving/pkg/controller/route/traffic"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayapiv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// Options bundles MakeHTTPRoute's generation knobs: which Gateway to
+// attach to, and any header/cookie canary rules per target group. It
+// mirrors istio.VirtualServiceOptions, minus TLS (Gateway API terminates
+// TLS on the Gateway's Listener, not per-route).
+type Options struct {
+	// ParentRefs names the Gateway(s) this HTTPRoute attaches to.
+	ParentRefs []gatewayapiv1.ParentReference
+	// CanaryRules are keyed by target-group name, same as
+	// istio.VirtualServiceOptions.CanaryRules.
+	CanaryRules map[string][]CanaryRule
+}
+
+// CanaryRule is the Gateway API analogue of istio.CanaryRule: it pins a
+// single revision behind a header/cookie match, evaluated ahead of the
+// weighted rule for its target group.
+type CanaryRule struct {
+	RevisionName string
+	Headers      []gatewayapiv1.HTTPHeaderMatch
+}
+
+// MakeHTTPRoute creates the Gateway API HTTPRoutes equivalent to
+// istio.MakeVirtualService: one HTTPRoute per traffic-target group (the
+// root, percent-split group plus one per tag), each scoped to its own
+// Hostnames, with canary rules spliced in ahead of their group's weighted
+// rule. Gateway API scopes Hostnames at the HTTPRoute level rather than
+// per-Rule, so a single merged HTTPRoute would let the root group's
+// no-Matches catch-all rule apply to tag subdomains too -- hence one object
+// per group rather than one shared object with several Rules. Unlike
+// Istio, Gateway API BackendRefs have no subset concept, so rules
+// reference the per-revision K8s Service directly and use
+// BackendRefs[].Weight for the split.
+func MakeHTTPRoute(u *v1alpha1.Route, tc *traffic.TrafficConfig, opts *Options) []*gatewayapiv1.HTTPRoute {
+	if opts == nil {
+		opts = &Options{}
+	}
+	names := make([]string, 0, len(tc.Targets))
+	for name := range tc.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	routes := make([]*gatewayapiv1.HTTPRoute, 0, len(names))
+	for _, name := range names {
+		routes = append(routes, makeHTTPRouteForGroup(u, name, tc.Targets[name], opts))
+	}
+	return routes
+}
+
+func makeHTTPRouteForGroup(u *v1alpha1.Route, name string, targets []traffic.RevisionTarget, opts *Options) *gatewayapiv1.HTTPRoute {
+	routeName := controller.GetHTTPRouteName(u)
+	if name != "" {
+		routeName = controller.GetHTTPRouteNameForTag(u, name)
+	}
+	var rules []gatewayapiv1.HTTPRouteRule
+	rules = append(rules, makeCanaryRules(u.Namespace, opts.CanaryRules[name])...)
+	if name != "" && len(targets) > 0 {
+		// A tag pins its first target at 100%, outside the root group's
+		// split, just as istio.makeTagRoute does.
+		pinned := targets[0]
+		pinned.Percent = 100
+		targets = []traffic.RevisionTarget{pinned}
+	}
+	rules = append(rules, makeWeightedRule(u.Namespace, targets))
+	return &gatewayapiv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            routeName,
+			Namespace:       u.Namespace,
+			Labels:          map[string]string{"route": u.Name},
+			OwnerReferences: []metav1.OwnerReference{*controller.NewRouteControllerRef(u)},
+		},
+		Spec: gatewayapiv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayapiv1.CommonRouteSpec{ParentRefs: opts.ParentRefs},
+			Hostnames:       getRouteHostnames(name, u.Status.Domain),
+			Rules:           sortRulesBySpecificity(rules),
+		},
+	}
+}
+
+func getRouteHostnames(targetName, domain string) []gatewayapiv1.Hostname {
+	if targetName == "" {
+		return []gatewayapiv1.Hostname{gatewayapiv1.Hostname(domain)}
+	}
+	return []gatewayapiv1.Hostname{gatewayapiv1.Hostname(fmt.Sprintf("%s.%s", targetName, domain))}
+}
+
+// makeCanaryRules renders each CanaryRule as its own HTTPRouteRule, a
+// single 100%-weight BackendRef to the pinned revision's Service.
+func makeCanaryRules(ns string, canaryRules []CanaryRule) []gatewayapiv1.HTTPRouteRule {
+	rules := make([]gatewayapiv1.HTTPRouteRule, 0, len(canaryRules))
+	for _, c := range canaryRules {
+		rules = append(rules, gatewayapiv1.HTTPRouteRule{
+			Matches: []gatewayapiv1.HTTPRouteMatch{{Headers: c.Headers}},
+			BackendRefs: []gatewayapiv1.HTTPBackendRef{
+				backendRefForRevision(ns, c.RevisionName, 100),
+			},
+		})
+	}
+	return rules
+}
+
+// makeWeightedRule is the Gateway API equivalent of makeVirtualServiceRoute:
+// one BackendRef per active revision, weighted by traffic percent, plus a
+// BackendRef to the activator for every inactive revision with a
+// RequestHeaderModifier filter standing in for Istio's AppendHeaders.
+func makeWeightedRule(ns string, targets []traffic.RevisionTarget) gatewayapiv1.HTTPRouteRule {
+	rule := gatewayapiv1.HTTPRouteRule{}
+	for _, t := range targets {
+		if t.Active {
+			if t.Percent == 0 {
+				continue
+			}
+			rule.BackendRefs = append(rule.BackendRefs, backendRefForRevision(ns, t.RevisionName, t.Percent))
+			continue
+		}
+		rule.BackendRefs = append(rule.BackendRefs, activatorBackendRef(ns, t))
+	}
+	return rule
+}
+
+func backendRefForRevision(ns, revisionName string, weight int) gatewayapiv1.HTTPBackendRef {
+	weight32 := int32(weight)
+	return gatewayapiv1.HTTPBackendRef{
+		BackendRef: gatewayapiv1.BackendRef{
+			BackendObjectReference: gatewayapiv1.BackendObjectReference{
+				Name: gatewayapiv1.ObjectName(controller.GetServingK8SServiceNameForObj(revisionName)),
+				Port: portPtr(revision.ServicePort),
+			},
+			Weight: &weight32,
+		},
+	}
+}
+
+// activatorBackendRef routes an inactive revision's share of traffic to the
+// activator, attaching a RequestHeaderModifier filter that adds the
+// revision-name/revision-namespace headers the activator needs -- the
+// Gateway API equivalent of the per-destination Headers used in
+// istio.addActivatorRoutes. The activator Service lives in the serving
+// system namespace, not the Route's own namespace, so BackendObjectReference
+// must set Namespace explicitly (BackendRefs default to the parent
+// HTTPRoute's namespace otherwise).
+func activatorBackendRef(ns string, t traffic.RevisionTarget) gatewayapiv1.HTTPBackendRef {
+	weight32 := int32(t.Percent)
+	activatorNamespace := gatewayapiv1.Namespace(pkg.GetServingSystemNamespace())
+	return gatewayapiv1.HTTPBackendRef{
+		BackendRef: gatewayapiv1.BackendRef{
+			BackendObjectReference: gatewayapiv1.BackendObjectReference{
+				Name:      gatewayapiv1.ObjectName(controller.GetServingK8SActivatorServiceName()),
+				Namespace: &activatorNamespace,
+				Port:      portPtr(revision.ServicePort),
+			},
+			Weight: &weight32,
+		},
+		Filters: []gatewayapiv1.HTTPRouteFilter{{
+			Type: gatewayapiv1.HTTPRouteFilterRequestHeaderModifier,
+			RequestHeaderModifier: &gatewayapiv1.HTTPHeaderFilter{
+				Add: []gatewayapiv1.HTTPHeader{
+					{Name: gatewayapiv1.HTTPHeaderName(controller.GetRevisionHeaderName()), Value: t.RevisionName},
+					{Name: gatewayapiv1.HTTPHeaderName(controller.GetRevisionHeaderNamespace()), Value: ns},
+				},
+			},
+		}},
+	}
+}
+
+func portPtr(p int) *gatewayapiv1.PortNumber {
+	port := gatewayapiv1.PortNumber(p)
+	return &port
+}
+
+// sortRulesBySpecificity orders rules so the most specific match wins ties
+// in Gateway API implementations (like Istio's translation layer) that
+// evaluate rules top-down: Exact header/path matches first, then Prefix,
+// then Regex, with the untagged catch-all (no Matches at all) last.
+func sortRulesBySpecificity(rules []gatewayapiv1.HTTPRouteRule) []gatewayapiv1.HTTPRouteRule {
+	sorted := make([]gatewayapiv1.HTTPRouteRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return ruleSpecificity(sorted[i]) > ruleSpecificity(sorted[j])
+	})
+	return sorted
+}
+
+// ruleSpecificity ranks a rule by its most specific match type: Exact (3)
+// > Prefix (2) > Regex (1) > no match / catch-all (0).
+func ruleSpecificity(rule gatewayapiv1.HTTPRouteRule) int {
+	best := 0
+	for _, m := range rule.Matches {
+		for _, h := range m.Headers {
+			best = max(best, headerMatchTypeRank(h.Type))
+		}
+		if m.Path != nil && m.Path.Type != nil {
+			best = max(best, pathMatchTypeRank(*m.Path.Type))
+		}
+	}
+	return best
+}
+
+func headerMatchTypeRank(t *gatewayapiv1.HeaderMatchType) int {
+	if t == nil {
+		return 0
+	}
+	switch *t {
+	case gatewayapiv1.HeaderMatchExact:
+		return 3
+	case gatewayapiv1.HeaderMatchRegularExpression:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func pathMatchTypeRank(t gatewayapiv1.PathMatchType) int {
+	switch t {
+	case gatewayapiv1.PathMatchExact:
+		return 3
+	case gatewayapiv1.PathMatchPathPrefix:
+		return 2
+	case gatewayapiv1.PathMatchRegularExpression:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/controller/route/traffic"
+)
+
+// CookieMatch pins a revision to requests carrying a particular cookie,
+// e.g. "user_group=beta".  Istio has no first-class cookie matcher, so it
+// is translated into a regex match against the "cookie" header.
+type CookieMatch struct {
+	Name  string
+	Value v1alpha3.StringMatch
+}
+
+// CanaryRule attaches a match predicate (HTTP headers and/or a cookie) to a
+// single revision, so that requests satisfying the predicate are pinned to
+// that revision regardless of the Route's percentage split.  CanaryRules
+// are evaluated, in order, before the weight-based route: Istio picks the
+// first HTTPRoute whose Match succeeds, so these must be sorted such that
+// more specific rules precede less specific ones.
+type CanaryRule struct {
+	RevisionName string
+	Headers      map[string]v1alpha3.StringMatch
+	Cookie       *CookieMatch
+	// Active mirrors traffic.RevisionTarget.Active: true if RevisionName
+	// currently has the Route's shared Service backing it directly, false
+	// if it's scaled to zero and matched traffic must be routed through
+	// the activator instead, exactly like the weight-based and tag routes.
+	Active bool
+}
+
+// cookieHeaderMatch renders a CookieMatch as the header match Istio
+// actually evaluates. The cookie name and any Exact/Prefix value are
+// regexp.QuoteMeta-escaped before being spliced into the regex, so a
+// literal value like "1.2" only ever matches the literal bytes "1.2" and
+// not, say, "1X2".
+func cookieHeaderMatch(c *CookieMatch) v1alpha3.StringMatch {
+	name := regexp.QuoteMeta(c.Name)
+	switch {
+	case c.Value.Exact != "":
+		return v1alpha3.StringMatch{Regex: fmt.Sprintf(`(^|.*;\s*)%s=%s(;.*|$)`, name, regexp.QuoteMeta(c.Value.Exact))}
+	case c.Value.Prefix != "":
+		return v1alpha3.StringMatch{Regex: fmt.Sprintf(`(^|.*;\s*)%s=%s.*`, name, regexp.QuoteMeta(c.Value.Prefix))}
+	case c.Value.Regex != "":
+		// The caller is explicitly asking for regex semantics here, so
+		// c.Value.Regex is spliced in as-is rather than escaped.
+		return v1alpha3.StringMatch{Regex: fmt.Sprintf(`(^|.*;\s*)%s=%s(;.*|$)`, name, c.Value.Regex)}
+	default:
+		// Presence-only: any value is acceptable, just require the cookie.
+		return v1alpha3.StringMatch{Regex: fmt.Sprintf(`(^|.*;\s*)%s=.*`, name)}
+	}
+}
+
+// makeCanaryRoutes builds one HTTPRoute per CanaryRule, each matching the
+// Route's domains ANDed with that rule's header/cookie predicate, and
+// routing 100% of matched traffic to the pinned revision via the Route's
+// DestinationRule subset (see destinationForRevision) -- or, if the rule's
+// revision is currently scaled to zero, through the activator, exactly
+// like the weight-based and tag routes fall back for inactive targets. The
+// returned routes must be placed ahead of the weight-based HTTPRoute so
+// Istio's first-match-wins semantics give them priority over the
+// percentage split.
+func makeCanaryRoutes(domains []string, u *v1alpha1.Route, rules []CanaryRule, tlsCfg *UpstreamTLSConfig) []v1alpha3.HTTPRoute {
+	ns := u.Namespace
+	routes := make([]v1alpha3.HTTPRoute, 0, len(rules))
+	for _, rule := range rules {
+		headers := map[string]v1alpha3.StringMatch{}
+		for k, v := range rule.Headers {
+			headers[k] = v
+		}
+		if rule.Cookie != nil {
+			headers["cookie"] = cookieHeaderMatch(rule.Cookie)
+		}
+		matches := make([]v1alpha3.HTTPMatchRequest, 0, len(domains))
+		for _, domain := range domains {
+			matches = append(matches, v1alpha3.HTTPMatchRequest{
+				Authority: &v1alpha3.StringMatch{Exact: domain},
+				Headers:   headers,
+			})
+		}
+		route := v1alpha3.HTTPRoute{Match: matches}
+		if !rule.Active {
+			routes = append(routes, *addActivatorRoutes(&route, ns, []traffic.RevisionTarget{
+				{TrafficTarget: traffic.TrafficTarget{RevisionName: rule.RevisionName}, Active: false, Percent: 100},
+			}))
+			continue
+		}
+		dw := v1alpha3.DestinationWeight{
+			Destination: destinationForRevision(u, rule.RevisionName),
+			Weight:      100,
+		}
+		applyUpstreamTLS(&dw, tlsCfg)
+		route.Route = []v1alpha3.DestinationWeight{dw}
+		route.AppendHeaders = forwardedProtoHeader(tlsCfg)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// ValidateCanaryRules rejects a set of CanaryRules that Istio's
+// first-match-wins evaluation would make ambiguous or partly unreachable.
+// Rules are assumed to be in evaluation order (the order makeCanaryRoutes
+// will emit them in). A later rule is unreachable if an earlier rule for a
+// different revision matches every request the later rule would: that
+// happens whenever the earlier rule's predicate set is a subset of the
+// later rule's keys, and generalizes (is equally or less specific than)
+// the later rule's match on each of those keys -- e.g. an earlier Prefix
+// match shadows a later Exact match on the same header that starts with
+// that prefix.
+func ValidateCanaryRules(rules []CanaryRule) error {
+	predicates := make([]map[string]v1alpha3.StringMatch, len(rules))
+	for i, rule := range rules {
+		if len(rule.Headers) == 0 && rule.Cookie == nil {
+			return fmt.Errorf("canary rule %d for revision %q has no header or cookie predicate", i, rule.RevisionName)
+		}
+		predicates[i] = normalizedPredicate(rule)
+	}
+	for j := 1; j < len(rules); j++ {
+		for i := 0; i < j; i++ {
+			if rules[i].RevisionName == rules[j].RevisionName {
+				continue
+			}
+			if shadows(predicates[i], predicates[j]) {
+				return fmt.Errorf("canary rule %d (revision %q) matches every request canary rule %d (revision %q) does; rule %d is unreachable", i, rules[i].RevisionName, j, rules[j].RevisionName, j)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizedPredicate flattens a CanaryRule's Headers and Cookie into a
+// single map keyed by HTTP header name, translating Cookie into its
+// "cookie" header match so the two predicate kinds compare uniformly.
+func normalizedPredicate(rule CanaryRule) map[string]v1alpha3.StringMatch {
+	predicate := make(map[string]v1alpha3.StringMatch, len(rule.Headers)+1)
+	for k, v := range rule.Headers {
+		predicate[k] = v
+	}
+	if rule.Cookie != nil {
+		predicate["cookie"] = cookieHeaderMatch(rule.Cookie)
+	}
+	return predicate
+}
+
+// shadows reports whether every request matching b's predicate also
+// matches a's: true when a requires no key b doesn't also require, and
+// a's match generalizes b's match on every one of those shared keys.
+func shadows(a, b map[string]v1alpha3.StringMatch) bool {
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok || !generalizes(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// generalizes reports whether every string a StringMatch b would accept is
+// also accepted by StringMatch a. Regexes aren't compared for containment
+// (undecidable in general here), so a Regex match never generalizes
+// another match.
+func generalizes(a, b v1alpha3.StringMatch) bool {
+	switch {
+	case a.Exact != "":
+		return b.Exact == a.Exact
+	case a.Prefix != "":
+		switch {
+		case b.Exact != "":
+			return strings.HasPrefix(b.Exact, a.Prefix)
+		case b.Prefix != "":
+			return strings.HasPrefix(b.Prefix, a.Prefix)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
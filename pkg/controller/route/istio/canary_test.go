@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+)
+
+func TestCookieHeaderMatchEscapesMetacharacters(t *testing.T) {
+	match := cookieHeaderMatch(&CookieMatch{
+		Name:  "a.b",
+		Value: v1alpha3.StringMatch{Exact: "1.2"},
+	})
+	if strings.Contains(match.Regex, "a.b=1.2") && !strings.Contains(match.Regex, `a\.b=1\.2`) {
+		t.Fatalf("expected cookie name/value metacharacters to be escaped, got regex %q", match.Regex)
+	}
+	if !strings.Contains(match.Regex, `a\.b`) || !strings.Contains(match.Regex, `1\.2`) {
+		t.Errorf("regex %q does not contain the escaped name/value", match.Regex)
+	}
+}
+
+func TestCookieHeaderMatchRegexPassedThroughUnescaped(t *testing.T) {
+	match := cookieHeaderMatch(&CookieMatch{
+		Name:  "group",
+		Value: v1alpha3.StringMatch{Regex: "beta.*"},
+	})
+	if !strings.Contains(match.Regex, "beta.*") {
+		t.Errorf("explicit regex value should be spliced in as-is, got %q", match.Regex)
+	}
+}
+
+func TestValidateCanaryRulesRequiresAPredicate(t *testing.T) {
+	err := ValidateCanaryRules([]CanaryRule{{RevisionName: "rev-a"}})
+	if err == nil {
+		t.Fatal("expected an error for a rule with no header or cookie predicate")
+	}
+}
+
+func TestValidateCanaryRulesDetectsShadowing(t *testing.T) {
+	rules := []CanaryRule{
+		{
+			RevisionName: "rev-a",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-canary": {Prefix: "beta"},
+			},
+		},
+		{
+			RevisionName: "rev-b",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-canary": {Exact: "beta-1"},
+			},
+		},
+	}
+	if err := ValidateCanaryRules(rules); err == nil {
+		t.Fatal("expected the earlier Prefix rule to shadow the later Exact rule for a different revision")
+	}
+}
+
+func TestValidateCanaryRulesAllowsSameRevisionOverlap(t *testing.T) {
+	rules := []CanaryRule{
+		{
+			RevisionName: "rev-a",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-canary": {Prefix: "beta"},
+			},
+		},
+		{
+			RevisionName: "rev-a",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-canary": {Exact: "beta-1"},
+			},
+		},
+	}
+	if err := ValidateCanaryRules(rules); err != nil {
+		t.Errorf("rules pinning the same revision should never be considered ambiguous: %v", err)
+	}
+}
+
+func TestValidateCanaryRulesAllowsDisjointRules(t *testing.T) {
+	rules := []CanaryRule{
+		{
+			RevisionName: "rev-a",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-user": {Exact: "alice"},
+			},
+		},
+		{
+			RevisionName: "rev-b",
+			Headers: map[string]v1alpha3.StringMatch{
+				"x-user": {Exact: "bob"},
+			},
+		},
+	}
+	if err := ValidateCanaryRules(rules); err != nil {
+		t.Errorf("disjoint Exact matches should never shadow each other: %v", err)
+	}
+}
+
+func TestGeneralizes(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b v1alpha3.StringMatch
+		want bool
+	}{
+		{"exact matches itself", v1alpha3.StringMatch{Exact: "beta"}, v1alpha3.StringMatch{Exact: "beta"}, true},
+		{"exact does not match a different exact", v1alpha3.StringMatch{Exact: "beta"}, v1alpha3.StringMatch{Exact: "alpha"}, false},
+		{"prefix generalizes a matching exact", v1alpha3.StringMatch{Prefix: "beta"}, v1alpha3.StringMatch{Exact: "beta-1"}, true},
+		{"prefix does not generalize a non-matching exact", v1alpha3.StringMatch{Prefix: "beta"}, v1alpha3.StringMatch{Exact: "alpha-1"}, false},
+		{"regex never generalizes", v1alpha3.StringMatch{Regex: ".*"}, v1alpha3.StringMatch{Exact: "beta"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := generalizes(c.a, c.b); got != c.want {
+				t.Errorf("generalizes(%+v, %+v) = %v, want %v", c.a, c.b, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	"github.com/knative/serving/pkg/apis/serving"
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/controller"
+	"github.com/knative/serving/pkg/controller/route/traffic"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultMaxConnections is the default TCP max connections applied to a
+	// revision subset.
+	DefaultMaxConnections = 1024
+	// DefaultHTTP1MaxPendingRequests is the default HTTP1 max pending request
+	// queue length applied to a revision subset.
+	DefaultHTTP1MaxPendingRequests = 1024
+	// DefaultHTTP2MaxRequests is the default number of concurrent HTTP2
+	// requests applied to a revision subset.
+	DefaultHTTP2MaxRequests = 1024
+	// DefaultConsecutiveErrors is the default number of consecutive 5xx
+	// errors that trigger outlier ejection for a revision subset.
+	DefaultConsecutiveErrors = 5
+	// DefaultBaseEjectionTimeSeconds is the default minimum time a revision
+	// subset host stays ejected after outlier detection trips.
+	DefaultBaseEjectionTimeSeconds = 30
+	// DefaultMaxEjectionPercent caps the fraction of hosts in a subset that
+	// outlier detection may eject at once.
+	DefaultMaxEjectionPercent = 100
+)
+
+// MakeDestinationRule creates an Istio DestinationRule for the Route's
+// headless Service, with one subset per revision that currently receives
+// traffic.  Subsets are referenced by name from the VirtualService's
+// HTTPRoute destinations so that per-revision resiliency policy (connection
+// pooling, outlier detection, load balancing) can be tuned without relying
+// solely on VirtualService traffic weights.
+func MakeDestinationRule(u *v1alpha1.Route, tc *traffic.TrafficConfig) *v1alpha3.DestinationRule {
+	return MakeDestinationRuleWithTLS(u, tc, nil)
+}
+
+// MakeDestinationRuleWithTLS is MakeDestinationRule, plus an optional
+// UpstreamTLSConfig applied as each subset's Tls policy.  A nil or disabled
+// tlsCfg leaves the generated DestinationRule identical to
+// MakeDestinationRule's.
+func MakeDestinationRuleWithTLS(u *v1alpha1.Route, tc *traffic.TrafficConfig, tlsCfg *UpstreamTLSConfig) *v1alpha3.DestinationRule {
+	return &v1alpha3.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            controller.GetDestinationRuleName(u),
+			Namespace:       u.Namespace,
+			Labels:          map[string]string{"route": u.Name},
+			OwnerReferences: []metav1.OwnerReference{*controller.NewRouteControllerRef(u)},
+		},
+		Spec: makeDestinationRuleSpec(u, tc.Targets, tlsCfg),
+	}
+}
+
+func makeDestinationRuleSpec(u *v1alpha1.Route, targets map[string][]traffic.RevisionTarget, tlsCfg *UpstreamTLSConfig) v1alpha3.DestinationRuleSpec {
+	spec := v1alpha3.DestinationRuleSpec{
+		Host:          controller.GetServingK8SServiceFullnameForRoute(u),
+		TrafficPolicy: makeDefaultTrafficPolicy(),
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	// Sort the target-group names so Subsets is built in a deterministic
+	// order, same as makeVirtualServiceSpec: ranging over targets directly
+	// would order spec.Subsets by Go's randomized map iteration, causing
+	// spurious diffs against the live DestinationRule on every reconcile.
+	sort.Strings(names)
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		for _, t := range targets[name] {
+			if _, ok := seen[t.RevisionName]; ok {
+				continue
+			}
+			seen[t.RevisionName] = struct{}{}
+			spec.Subsets = append(spec.Subsets, makeSubset(u, t.RevisionName, tlsCfg))
+		}
+	}
+	return spec
+}
+
+// makeSubset builds the DestinationRule subset for a single revision.  The
+// subset's label selector matches the revision label applied to the
+// revision's own K8s Service, so Istio can scope a VirtualService
+// destination down to that single revision.  When tlsCfg is enabled the
+// subset also carries the Tls policy used to dial that revision over the
+// mesh.
+func makeSubset(u *v1alpha1.Route, revisionName string, tlsCfg *UpstreamTLSConfig) v1alpha3.Subset {
+	subset := v1alpha3.Subset{
+		Name: revisionName,
+		Labels: map[string]string{
+			serving.RevisionLabelKey: revisionName,
+		},
+	}
+	if tls := destinationRuleTLSSettings(tlsCfg, u, revisionName); tls != nil {
+		subset.TrafficPolicy = &v1alpha3.TrafficPolicy{Tls: tls}
+	}
+	return subset
+}
+
+// makeDefaultTrafficPolicy returns the connection pooling, outlier
+// detection, and load balancing policy applied to all subsets.  These
+// defaults mirror the conservative settings Istio itself ships with.  They
+// are fixed: MakeDestinationRule reads no per-Route override, so every
+// Route's DestinationRule carries these same values.
+func makeDefaultTrafficPolicy() *v1alpha3.TrafficPolicy {
+	return &v1alpha3.TrafficPolicy{
+		ConnectionPool: &v1alpha3.ConnectionPoolSettings{
+			HTTP: &v1alpha3.HTTPSettings{
+				HTTP1MaxPendingRequests: DefaultHTTP1MaxPendingRequests,
+				HTTP2MaxRequests:        DefaultHTTP2MaxRequests,
+			},
+			TCP: &v1alpha3.TCPSettings{
+				MaxConnections: DefaultMaxConnections,
+			},
+		},
+		OutlierDetection: &v1alpha3.OutlierDetection{
+			ConsecutiveErrors:  DefaultConsecutiveErrors,
+			BaseEjectionTime:   fmt.Sprintf("%ds", DefaultBaseEjectionTimeSeconds),
+			MaxEjectionPercent: DefaultMaxEjectionPercent,
+		},
+		LoadBalancer: &v1alpha3.LoadBalancerSettings{
+			Simple: v1alpha3.LoadBalancerSimpleRoundRobin,
+		},
+	}
+}
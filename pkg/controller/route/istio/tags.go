@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"github.com/knative/serving/pkg/controller/route/traffic"
+)
+
+// BuildVirtualService is the canonical entry point for generating a Route's
+// VirtualService together with its tag bindings: makeVirtualServiceSpec
+// emits one untagged, percent-split HTTPRoute for the "" target group and
+// one single-destination HTTPRoute per tag (see makeTagRoute), and this
+// wraps that with the tag -> revision bindings the Route reconciler needs
+// to publish each tag's URL to Route.Status.Traffic, mirroring the URLs
+// `kn service update --tag` prints.
+func BuildVirtualService(u *v1alpha1.Route, tc *traffic.TrafficConfig, opts *VirtualServiceOptions) (*v1alpha3.VirtualService, []TagBinding, error) {
+	vs, err := MakeVirtualServiceWithOptions(u, tc, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vs, TagBindingsFromTargets(u, tc), nil
+}
+
+// TagBinding pairs a named traffic target ("tag") with the single revision
+// it pins to and the subdomain the tag is reachable at.
+type TagBinding struct {
+	Tag          string
+	RevisionName string
+	URL          string
+}
+
+// TagBindingsFromTargets extracts the tag -> revision bindings implied by
+// tc.Targets.  Every non-empty key in the Targets map names a tag that
+// pins a single revision (see makeTagRoute); the "" key is the root,
+// percent-split route and is not a tag.
+func TagBindingsFromTargets(u *v1alpha1.Route, tc *traffic.TrafficConfig) []TagBinding {
+	domain := u.Status.Domain
+	var tags []string
+	for name := range tc.Targets {
+		if name == "" {
+			continue
+		}
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+
+	bindings := make([]TagBinding, 0, len(tags))
+	for _, tag := range tags {
+		targets := tc.Targets[tag]
+		if len(targets) == 0 {
+			continue
+		}
+		// A tag always pins a single revision at 100%; if the traffic
+		// config ever produces more than one target for a tag, the first
+		// one (highest priority by construction) wins.
+		bindings = append(bindings, TagBinding{
+			Tag:          tag,
+			RevisionName: targets[0].RevisionName,
+			URL:          fmt.Sprintf("%s.%s", tag, domain),
+		})
+	}
+	return bindings
+}
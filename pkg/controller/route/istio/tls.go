@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"fmt"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	"github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// TLSPortName is the name of the Revision Service port that terminates
+	// upstream TLS, as opposed to PortName which carries plaintext HTTP.
+	TLSPortName = "https"
+	// TLSPortNumber is the container port that terminates upstream TLS.
+	TLSPortNumber = 443
+
+	// SNIAnnotationKey lets a Route override the SNI server name presented
+	// to a revision's upstream TLS listener, instead of the canonical
+	// "kn-user-<namespace>-<revision>" name.
+	SNIAnnotationKey = "serving.knative.dev/sni"
+
+	// ForwardedProtoHeader is appended to mesh-to-Revision requests once
+	// TLS termination has already happened at the ingress, so user
+	// containers can still observe "https" in X-Forwarded-Proto.
+	ForwardedProtoHeader = "x-forwarded-proto"
+	httpsScheme          = "https"
+
+	// SystemInternalTLSKey is the config-network key that opts a cluster
+	// into mesh-to-Revision TLS. Its only accepted "on" value is "enabled";
+	// anything else (including the key being absent) leaves TLS off.
+	SystemInternalTLSKey = "system-internal-tls"
+	// SystemInternalTLSEnabledValue is the SystemInternalTLSKey value that
+	// turns upstream TLS on.
+	SystemInternalTLSEnabledValue = "enabled"
+	// SystemInternalTLSModeKey selects "SIMPLE" or "MUTUAL"; defaults to
+	// SIMPLE when unset.
+	SystemInternalTLSModeKey = "system-internal-tls-mode"
+	// SystemInternalTLSSecretNameKey names the Secret holding the CA bundle
+	// (and, for MUTUAL, the client cert/key) used to dial Revision pods.
+	SystemInternalTLSSecretNameKey = "system-internal-tls-secret-name"
+)
+
+// UpstreamTLSConfig carries the subset of config-network that governs
+// mesh-to-Revision TLS.  It is read once from the config-network ConfigMap
+// by the caller and threaded through to the generators below; when Enabled
+// is false every function in this file is a clean no-op so plaintext flows
+// are byte-for-byte unaffected.
+type UpstreamTLSConfig struct {
+	// Enabled turns on "system-internal-tls" end-to-end: VirtualServices
+	// target the Revision's TLS port and DestinationRules add a Tls policy.
+	Enabled bool
+	// Mode is either "SIMPLE" (verify server only) or "MUTUAL" (verify
+	// both directions using CertSecretName as the client identity too).
+	Mode string
+	// CertSecretName names the Secret, mounted alongside the Istio proxy,
+	// holding the CA bundle and (for MUTUAL) the client cert/key used to
+	// dial Revision pods.
+	CertSecretName string
+}
+
+// NewUpstreamTLSConfigFromConfigMap reads the system-internal-tls family of
+// keys out of the config-network ConfigMap. A nil ConfigMap, or one missing
+// SystemInternalTLSKey entirely, returns a disabled config so every function
+// in this file stays a no-op, matching today's plaintext-only default.
+func NewUpstreamTLSConfigFromConfigMap(configMap *corev1.ConfigMap) *UpstreamTLSConfig {
+	if configMap == nil || configMap.Data[SystemInternalTLSKey] != SystemInternalTLSEnabledValue {
+		return &UpstreamTLSConfig{}
+	}
+	mode := configMap.Data[SystemInternalTLSModeKey]
+	if mode == "" {
+		mode = "SIMPLE"
+	}
+	return &UpstreamTLSConfig{
+		Enabled:        true,
+		Mode:           mode,
+		CertSecretName: configMap.Data[SystemInternalTLSSecretNameKey],
+	}
+}
+
+// canonicalSNI returns the SNI server name Activator/Istio present when
+// dialing the given revision, unless the Route annotates an override via
+// SNIAnnotationKey.
+func canonicalSNI(u *v1alpha1.Route, revisionName string) string {
+	if sni, ok := u.Annotations[SNIAnnotationKey]; ok && sni != "" {
+		return sni
+	}
+	return fmt.Sprintf("kn-user-%s-%s", u.Namespace, revisionName)
+}
+
+// applyUpstreamTLS mutates a DestinationWeight in place so it targets the
+// revision's TLS port when cfg.Enabled. It is a no-op when cfg is nil or
+// disabled.
+func applyUpstreamTLS(dw *v1alpha3.DestinationWeight, cfg *UpstreamTLSConfig) {
+	if cfg == nil || !cfg.Enabled {
+		return
+	}
+	dw.Destination.Port = v1alpha3.PortSelector{Number: TLSPortNumber}
+}
+
+// destinationRuleTLSSettings builds the per-subset Tls policy applied to a
+// DestinationRule subset when upstream TLS is enabled, or nil otherwise.
+func destinationRuleTLSSettings(cfg *UpstreamTLSConfig, u *v1alpha1.Route, revisionName string) *v1alpha3.TLSSettings {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	mode := v1alpha3.TLSModeSimple
+	if cfg.Mode == "MUTUAL" {
+		mode = v1alpha3.TLSModeMutual
+	}
+	settings := &v1alpha3.TLSSettings{
+		Mode:           mode,
+		CACertificates: caCertPath(cfg.CertSecretName),
+		SNI:            canonicalSNI(u, revisionName),
+	}
+	if mode == v1alpha3.TLSModeMutual {
+		settings.ClientCertificate = clientCertPath(cfg.CertSecretName)
+		settings.PrivateKey = privateKeyPath(cfg.CertSecretName)
+	}
+	return settings
+}
+
+// forwardedProtoHeader returns the AppendHeaders entry an HTTPRoute should
+// add once TLS has already been terminated upstream of the Revision, so the
+// user container still sees "https" via X-Forwarded-Proto.
+func forwardedProtoHeader(cfg *UpstreamTLSConfig) map[string]string {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	return map[string]string{ForwardedProtoHeader: httpsScheme}
+}
+
+// The cert Secret is projected onto the Istio proxy filesystem by the
+// standard Istio cert-injection path; these helpers just compute the
+// well-known paths within that mount.
+func caCertPath(secretName string) string     { return fmt.Sprintf("/etc/istio/%s/ca.crt", secretName) }
+func clientCertPath(secretName string) string { return fmt.Sprintf("/etc/istio/%s/tls.crt", secretName) }
+func privateKeyPath(secretName string) string { return fmt.Sprintf("/etc/istio/%s/tls.key", secretName) }
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"testing"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNewUpstreamTLSConfigFromConfigMapDisabledByDefault(t *testing.T) {
+	for _, configMap := range []*corev1.ConfigMap{
+		nil,
+		{},
+		{Data: map[string]string{SystemInternalTLSKey: "not-enabled"}},
+	} {
+		if cfg := NewUpstreamTLSConfigFromConfigMap(configMap); cfg.Enabled {
+			t.Errorf("NewUpstreamTLSConfigFromConfigMap(%+v).Enabled = true, want false", configMap)
+		}
+	}
+}
+
+func TestNewUpstreamTLSConfigFromConfigMapEnabled(t *testing.T) {
+	configMap := &corev1.ConfigMap{Data: map[string]string{
+		SystemInternalTLSKey:           SystemInternalTLSEnabledValue,
+		SystemInternalTLSModeKey:       "MUTUAL",
+		SystemInternalTLSSecretNameKey: "istio-internal-tls",
+	}}
+	cfg := NewUpstreamTLSConfigFromConfigMap(configMap)
+	if !cfg.Enabled {
+		t.Fatal("expected Enabled to be true")
+	}
+	if cfg.Mode != "MUTUAL" {
+		t.Errorf("Mode = %q, want MUTUAL", cfg.Mode)
+	}
+	if cfg.CertSecretName != "istio-internal-tls" {
+		t.Errorf("CertSecretName = %q, want istio-internal-tls", cfg.CertSecretName)
+	}
+}
+
+func TestNewUpstreamTLSConfigFromConfigMapDefaultsModeToSimple(t *testing.T) {
+	configMap := &corev1.ConfigMap{Data: map[string]string{
+		SystemInternalTLSKey: SystemInternalTLSEnabledValue,
+	}}
+	if cfg := NewUpstreamTLSConfigFromConfigMap(configMap); cfg.Mode != "SIMPLE" {
+		t.Errorf("Mode = %q, want SIMPLE when unset", cfg.Mode)
+	}
+}
+
+func TestApplyUpstreamTLS(t *testing.T) {
+	dw := v1alpha3.DestinationWeight{Destination: v1alpha3.Destination{Port: v1alpha3.PortSelector{Number: PortNumber}}}
+
+	applyUpstreamTLS(&dw, nil)
+	if dw.Destination.Port.Number != PortNumber {
+		t.Errorf("a nil cfg must be a no-op, got port %d", dw.Destination.Port.Number)
+	}
+
+	applyUpstreamTLS(&dw, &UpstreamTLSConfig{Enabled: false})
+	if dw.Destination.Port.Number != PortNumber {
+		t.Errorf("a disabled cfg must be a no-op, got port %d", dw.Destination.Port.Number)
+	}
+
+	applyUpstreamTLS(&dw, &UpstreamTLSConfig{Enabled: true})
+	if dw.Destination.Port.Number != TLSPortNumber {
+		t.Errorf("an enabled cfg must rewrite the port to %d, got %d", TLSPortNumber, dw.Destination.Port.Number)
+	}
+}
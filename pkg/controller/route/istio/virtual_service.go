@@ -39,6 +39,52 @@ const (
 // MakeVirtualService creates an Istio VirtualService to set up routing rules.  Such VirtualService specifies
 // which Gateways and Hosts that it applies to, as well as the routing rules.
 func MakeVirtualService(u *v1alpha1.Route, tc *traffic.TrafficConfig) *v1alpha3.VirtualService {
+	// nil opts carries no CanaryRules, so validation can't fail here.
+	vs, _ := MakeVirtualServiceWithOptions(u, tc, nil)
+	return vs
+}
+
+// MakeVirtualServiceWithTLS is MakeVirtualService, plus an optional
+// UpstreamTLSConfig.  When tlsCfg is nil or disabled this is identical to
+// MakeVirtualService; when enabled, routes target the Revision's TLS port
+// and carry the x-forwarded-proto: https header the plaintext path doesn't
+// need.
+func MakeVirtualServiceWithTLS(u *v1alpha1.Route, tc *traffic.TrafficConfig, tlsCfg *UpstreamTLSConfig) *v1alpha3.VirtualService {
+	var opts *VirtualServiceOptions
+	if tlsCfg != nil {
+		opts = &VirtualServiceOptions{TLS: *tlsCfg}
+	}
+	// opts carries no CanaryRules here either, so validation can't fail.
+	vs, _ := MakeVirtualServiceWithOptions(u, tc, opts)
+	return vs
+}
+
+// VirtualServiceOptions bundles the generation knobs layered onto the base
+// weight-based routing: upstream TLS and per-target-group canary rules.
+// A nil *VirtualServiceOptions, or a zero-value one, reproduces
+// MakeVirtualService's output exactly.
+type VirtualServiceOptions struct {
+	TLS UpstreamTLSConfig
+	// CanaryRules are keyed by the same target-group name tc.Targets uses
+	// (most commonly "", the root group); each entry is evaluated, in
+	// order, ahead of that group's weight-based HTTPRoute.
+	CanaryRules map[string][]CanaryRule
+}
+
+// MakeVirtualServiceWithOptions is MakeVirtualService with the full set of
+// optional generation knobs. Passing nil reproduces MakeVirtualService. Each
+// target group's CanaryRules are run through ValidateCanaryRules before any
+// HTTPRoute is generated, so an ambiguous or partly-unreachable canary
+// configuration is rejected outright instead of silently shipping.
+func MakeVirtualServiceWithOptions(u *v1alpha1.Route, tc *traffic.TrafficConfig, opts *VirtualServiceOptions) (*v1alpha3.VirtualService, error) {
+	if opts == nil {
+		opts = &VirtualServiceOptions{}
+	}
+	for name, rules := range opts.CanaryRules {
+		if err := ValidateCanaryRules(rules); err != nil {
+			return nil, fmt.Errorf("invalid canary rules for target group %q: %w", name, err)
+		}
+	}
 	return &v1alpha3.VirtualService{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            controller.GetVirtualServiceName(u),
@@ -46,11 +92,11 @@ func MakeVirtualService(u *v1alpha1.Route, tc *traffic.TrafficConfig) *v1alpha3.
 			Labels:          map[string]string{"route": u.Name},
 			OwnerReferences: []metav1.OwnerReference{*controller.NewRouteControllerRef(u)},
 		},
-		Spec: makeVirtualServiceSpec(u, tc.Targets),
-	}
+		Spec: makeVirtualServiceSpec(u, tc.Targets, opts),
+	}, nil
 }
 
-func makeVirtualServiceSpec(u *v1alpha1.Route, targets map[string][]traffic.RevisionTarget) v1alpha3.VirtualServiceSpec {
+func makeVirtualServiceSpec(u *v1alpha1.Route, targets map[string][]traffic.RevisionTarget, opts *VirtualServiceOptions) v1alpha3.VirtualServiceSpec {
 	domain := u.Status.Domain
 	spec := v1alpha3.VirtualServiceSpec{
 		// We want to connect to two Gateways: the Knative shared
@@ -76,12 +122,77 @@ func makeVirtualServiceSpec(u *v1alpha1.Route, targets map[string][]traffic.Revi
 	// Sort the names to give things a deterministic ordering.
 	sort.Strings(names)
 	// The routes are matching rule based on domain name to traffic split targets.
+	// The "" name is the root, percent-split route; every other name is a tag
+	// that pins a single revision behind its own "<tag>.<domain>" subdomain,
+	// bypassing the split entirely (see makeTagRoute and TagBindingsFromTargets,
+	// which surfaces these bindings for the reconciler to publish to
+	// Route.Status).
 	for _, name := range names {
-		spec.Http = append(spec.Http, *makeVirtualServiceRoute(getRouteDomains(name, u, domain), u.Namespace, targets[name]))
+		domains := getRouteDomains(name, u, domain)
+		// Canary rules for this target group are evaluated before the
+		// weight-based route: Istio picks the first HTTPRoute whose Match
+		// succeeds, so header/cookie-pinned traffic must be listed first.
+		for _, canaryRoute := range makeCanaryRoutes(domains, u, opts.CanaryRules[name], &opts.TLS) {
+			spec.Http = append(spec.Http, canaryRoute)
+		}
+		if name == "" {
+			spec.Http = append(spec.Http, *makeVirtualServiceRoute(domains, u, targets[name], &opts.TLS))
+			continue
+		}
+		spec.Http = append(spec.Http, *makeTagRoute(domains, u, targets[name], &opts.TLS))
 	}
 	return spec
 }
 
+// makeTagRoute builds the single, 100%-weight HTTPRoute for a tag: tags
+// pin one revision and must not participate in the root route's percentage
+// split, so this bypasses makeVirtualServiceRoute's weighted-blend and
+// multi-destination activator fan-out entirely.
+func makeTagRoute(domains []string, u *v1alpha1.Route, targets []traffic.RevisionTarget, tlsCfg *UpstreamTLSConfig) *v1alpha3.HTTPRoute {
+	ns := u.Namespace
+	matches := make([]v1alpha3.HTTPMatchRequest, 0, len(domains))
+	for _, domain := range domains {
+		matches = append(matches, v1alpha3.HTTPMatchRequest{
+			Authority: &v1alpha3.StringMatch{Exact: domain},
+		})
+	}
+	route := &v1alpha3.HTTPRoute{Match: matches}
+	if len(targets) == 0 {
+		return route
+	}
+	// A tag always resolves to exactly one target; pin 100% of its traffic
+	// to that revision (or, if it's scaled to zero, to the activator).
+	t := targets[0]
+	if !t.Active {
+		return addActivatorRoutes(route, ns, []traffic.RevisionTarget{{TrafficTarget: t.TrafficTarget, Active: false, Percent: 100}})
+	}
+	dw := v1alpha3.DestinationWeight{
+		Destination: destinationForRevision(u, t.TrafficTarget.RevisionName),
+		Weight:      100,
+	}
+	applyUpstreamTLS(&dw, tlsCfg)
+	route.Route = []v1alpha3.DestinationWeight{dw}
+	route.AppendHeaders = forwardedProtoHeader(tlsCfg)
+	return route
+}
+
+// destinationForRevision builds the Destination that pins traffic to a
+// single revision via the Route's DestinationRule subset (see
+// MakeDestinationRule). Istio only resolves Destination.Subset against a
+// DestinationRule whose Host matches exactly, so this targets the Route's
+// shared headless Service -- the same Host MakeDestinationRule uses -- and
+// not the revision's own per-revision Service, which the DestinationRule
+// never describes.
+func destinationForRevision(u *v1alpha1.Route, revisionName string) v1alpha3.Destination {
+	return v1alpha3.Destination{
+		Host:   controller.GetServingK8SServiceFullnameForRoute(u),
+		Subset: revisionName,
+		Port: v1alpha3.PortSelector{
+			Number: uint32(revision.ServicePort),
+		},
+	}
+}
+
 func getRouteDomains(targetName string, u *v1alpha1.Route, domain string) []string {
 	if targetName == "" {
 		// Nameless traffic targets correspond to two domains: the Route.Status.Domain, and also the FQDN
@@ -92,7 +203,8 @@ func getRouteDomains(targetName string, u *v1alpha1.Route, domain string) []stri
 	return []string{fmt.Sprintf("%s.%s", targetName, domain)}
 }
 
-func makeVirtualServiceRoute(domains []string, ns string, targets []traffic.RevisionTarget) *v1alpha3.HTTPRoute {
+func makeVirtualServiceRoute(domains []string, u *v1alpha1.Route, targets []traffic.RevisionTarget, tlsCfg *UpstreamTLSConfig) *v1alpha3.HTTPRoute {
+	ns := u.Namespace
 	matches := []v1alpha3.HTTPMatchRequest{}
 	// Istio list of matches are OR'ed together.  The following build a match set that matches any of the given domains.
 	for _, domain := range domains {
@@ -108,20 +220,17 @@ func makeVirtualServiceRoute(domains []string, ns string, targets []traffic.Revi
 		if t.Percent == 0 {
 			continue
 		}
-		weights = append(weights, v1alpha3.DestinationWeight{
-			Destination: v1alpha3.Destination{
-				Host: controller.GetK8SServiceFullname(
-					controller.GetServingK8SServiceNameForObj(t.TrafficTarget.RevisionName), ns),
-				Port: v1alpha3.PortSelector{
-					Number: uint32(revision.ServicePort),
-				},
-			},
-			Weight: t.Percent,
-		})
+		dw := v1alpha3.DestinationWeight{
+			Destination: destinationForRevision(u, t.TrafficTarget.RevisionName),
+			Weight:      t.Percent,
+		}
+		applyUpstreamTLS(&dw, tlsCfg)
+		weights = append(weights, dw)
 	}
 	route := v1alpha3.HTTPRoute{
-		Match: matches,
-		Route: weights,
+		Match:         matches,
+		Route:         weights,
+		AppendHeaders: forwardedProtoHeader(tlsCfg),
 	}
 	// Add traffic rules for activator.
 	return addActivatorRoutes(&route, ns, inactive)
@@ -131,40 +240,43 @@ func makeVirtualServiceRoute(domains []string, ns string, targets []traffic.Revi
 // Activator routing logic.
 /////////////////////////////////////////////////
 
-// TODO: The ideal solution is to append different revision name as headers for each inactive revision.
-// See https://github.com/istio/issues/issues/332
+// addActivatorRoutes directs traffic for every inactive RevisionTarget to
+// the activator, one weighted Destination per revision, each carrying its
+// own per-destination header-add so the activator learns the correct
+// revision-name/revision-namespace for the request it actually received.
 //
-// We will direct traffic for all inactive revisions to activator service; and the activator will send
-// the request to the inactive revision with the largest traffic weight.
-// The consequence of using appendHeaders at Spec is: if there are more than one inactive revisions, the
-// traffic split percentage would be distorted in a short period of time.
+// This used to collapse all inactive revisions into a single Destination
+// tagged with whichever one happened to have the largest weight, which
+// sent every inactive-revision request to the activator as if it were for
+// that one revision. Per-destination Headers (Istio >=1.1) let each
+// weighted branch carry its own tag, so the fix is to stop collapsing:
+// every inactive revision gets its own Destination, weight, and headers,
+// and Istio's weighted selection itself preserves the traffic split.
 func addActivatorRoutes(r *v1alpha3.HTTPRoute, ns string, inactive []traffic.RevisionTarget) *v1alpha3.HTTPRoute {
 	if len(inactive) == 0 {
 		// No need to change
 		return r
 	}
-	totalInactivePercent := 0
-	maxInactiveTarget := traffic.RevisionTarget{}
-
+	activatorHost := fmt.Sprintf("%s.%s.svc.cluster.local", controller.GetServingK8SActivatorServiceName(), pkg.GetServingSystemNamespace())
 	for _, t := range inactive {
-		totalInactivePercent += t.Percent
-		if t.Percent >= maxInactiveTarget.Percent {
-			maxInactiveTarget = t
-		}
-	}
-	r.Route = append(r.Route, v1alpha3.DestinationWeight{
-		Destination: v1alpha3.Destination{
-			Host: fmt.Sprintf("%s.%s.svc.cluster.local", controller.GetServingK8SActivatorServiceName(), pkg.GetServingSystemNamespace()),
-			Port: v1alpha3.PortSelector{
-				Number: uint32(revision.ServicePort),
+		r.Route = append(r.Route, v1alpha3.DestinationWeight{
+			Destination: v1alpha3.Destination{
+				Host: activatorHost,
+				Port: v1alpha3.PortSelector{
+					Number: uint32(revision.ServicePort),
+				},
 			},
-		},
-		Weight: totalInactivePercent,
-	})
-	r.AppendHeaders = map[string]string{
-		controller.GetRevisionHeaderName():      maxInactiveTarget.RevisionName,
-		controller.GetRevisionHeaderNamespace(): ns,
-		EnvoyTimeoutHeader:                      DefaultEnvoyTimeoutMs,
+			Weight: t.Percent,
+			Headers: &v1alpha3.Headers{
+				Request: &v1alpha3.HeaderOperations{
+					Add: map[string]string{
+						controller.GetRevisionHeaderName():      t.RevisionName,
+						controller.GetRevisionHeaderNamespace(): ns,
+						EnvoyTimeoutHeader:                      DefaultEnvoyTimeoutMs,
+					},
+				},
+			},
+		})
 	}
 	return r
 }
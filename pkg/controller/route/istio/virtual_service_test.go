@@ -0,0 +1,102 @@
+/*
+Copyright 2018 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package istio
+
+import (
+	"testing"
+
+	"github.com/knative/serving/pkg/apis/istio/v1alpha3"
+	"github.com/knative/serving/pkg/controller"
+	"github.com/knative/serving/pkg/controller/route/traffic"
+)
+
+func revisionTarget(name string, active bool, percent int) traffic.RevisionTarget {
+	return traffic.RevisionTarget{
+		TrafficTarget: traffic.TrafficTarget{RevisionName: name},
+		Active:        active,
+		Percent:       percent,
+	}
+}
+
+func TestGroupInactiveTargets(t *testing.T) {
+	targets := []traffic.RevisionTarget{
+		revisionTarget("rev-active", true, 80),
+		revisionTarget("rev-inactive-1", false, 10),
+		revisionTarget("rev-inactive-2", false, 10),
+	}
+
+	active, inactive := groupInactiveTargets(targets)
+
+	if len(active) != 1 || active[0].RevisionName != "rev-active" {
+		t.Fatalf("active = %+v, want only rev-active", active)
+	}
+	if len(inactive) != 2 {
+		t.Fatalf("inactive = %+v, want 2 targets", inactive)
+	}
+	for _, name := range []string{"rev-inactive-1", "rev-inactive-2"} {
+		found := false
+		for _, t := range inactive {
+			if t.RevisionName == name {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("inactive targets missing %s", name)
+		}
+	}
+}
+
+func TestAddActivatorRoutesGivesEachInactiveRevisionItsOwnDestination(t *testing.T) {
+	inactive := []traffic.RevisionTarget{
+		revisionTarget("rev-inactive-1", false, 70),
+		revisionTarget("rev-inactive-2", false, 30),
+	}
+	route := addActivatorRoutes(&v1alpha3.HTTPRoute{}, "ns", inactive)
+
+	if len(route.Route) != len(inactive) {
+		t.Fatalf("got %d destinations, want %d -- one per inactive revision, not collapsed into one", len(route.Route), len(inactive))
+	}
+	for i, t2 := range inactive {
+		dw := route.Route[i]
+		if dw.Weight != t2.Percent {
+			t.Errorf("destination %d: Weight = %d, want %d", i, dw.Weight, t2.Percent)
+		}
+		if dw.Headers == nil || dw.Headers.Request == nil {
+			t.Fatalf("destination %d: missing per-destination Headers.Request", i)
+		}
+		if got := dw.Headers.Request.Add[controller.GetRevisionHeaderName()]; got != t2.RevisionName {
+			t.Errorf("destination %d: revision header = %q, want %q", i, got, t2.RevisionName)
+		}
+		if got := dw.Headers.Request.Add[controller.GetRevisionHeaderNamespace()]; got != "ns" {
+			t.Errorf("destination %d: revision namespace header = %q, want %q", i, got, "ns")
+		}
+	}
+}
+
+func TestGroupInactiveTargetsAllActive(t *testing.T) {
+	targets := []traffic.RevisionTarget{
+		revisionTarget("rev-a", true, 50),
+		revisionTarget("rev-b", true, 50),
+	}
+	active, inactive := groupInactiveTargets(targets)
+	if len(active) != 2 {
+		t.Errorf("active = %+v, want 2 targets", active)
+	}
+	if len(inactive) != 0 {
+		t.Errorf("inactive = %+v, want none", inactive)
+	}
+}